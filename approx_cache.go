@@ -0,0 +1,245 @@
+package dejavu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+const (
+	approxSaveMagic = "DJVB"
+)
+
+// An ApproxCache is a Bloom filter: it trades the exactness of a Cache for
+// roughly an order of magnitude less memory, at the cost of a known,
+// tunable false-positive rate on Recall. Insert never forgets a value it
+// has seen, and Recall never reports a cached value as absent, but it may
+// occasionally report an uncached one as present.
+//
+// Reach for an ApproxCache instead of a Cache when callers can tolerate
+// that false-positive rate, e.g. deciding whether a downstream lookup is
+// worth paying for, rather than enforcing a correctness or security
+// guarantee.
+type ApproxCache struct {
+	bits []byte // m bits, packed 8 to a byte
+
+	mutex sync.Mutex
+
+	m     uint64 // number of bits in the filter
+	k     uint64 // number of hash functions (probe positions) per value
+	count int    // number of values inserted, for Save's header
+}
+
+// NewBloomCache creates a new ApproxCache sized to hold n values at
+// falsePositiveRate, using the standard Bloom filter formulas:
+//
+//	m = -n*ln(p) / (ln2)^2 bits
+//	k = (m/n)*ln2 hash functions
+func NewBloomCache(n uint32, falsePositiveRate float64) *ApproxCache {
+	var (
+		m = bloomBits(uint64(n), falsePositiveRate)
+		k = bloomHashes(m, uint64(n))
+	)
+
+	return &ApproxCache{
+		bits: make([]byte, (m+bitsPerByte-1)/bitsPerByte),
+
+		m: m,
+		k: k,
+	}
+}
+
+// Insert marks a value as cached. Unlike Cache, values may be of any
+// length.
+func (a *ApproxCache) Insert(value []byte) (e error) {
+	a.mutex.Lock()
+
+	defer a.mutex.Unlock()
+
+	var (
+		h1, h2 = a.hashes(value)
+		i      uint64
+	)
+
+	for i = 0; i < a.k; i++ {
+		a.setBit((h1 + i*h2) % a.m)
+	}
+
+	a.count++
+
+	return
+}
+
+// Recall returns true if a value is probably cached. False positives occur
+// at roughly the rate NewBloomCache was asked for; false negatives never
+// occur.
+func (a *ApproxCache) Recall(value []byte) (cached bool, e error) {
+	a.mutex.Lock()
+
+	defer a.mutex.Unlock()
+
+	var (
+		h1, h2 = a.hashes(value)
+		i      uint64
+	)
+
+	for i = 0; i < a.k; i++ {
+		if !a.bit((h1 + i*h2) % a.m) {
+			return
+		}
+	}
+
+	cached = true
+
+	return
+}
+
+// Save writes the filter's bits to an [io.Writer], behind a small header
+// identifying its size, so Load can verify compatibility.
+func (a *ApproxCache) Save(writer io.Writer) (e error) {
+	a.mutex.Lock()
+
+	defer a.mutex.Unlock()
+
+	_, e = io.WriteString(writer, approxSaveMagic)
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, a.m)
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, a.k)
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, uint64(a.count))
+	if e != nil {
+		return
+	}
+
+	_, e = writer.Write(a.bits)
+
+	return
+}
+
+// Counterpart to Save, Load reads a filter's bits from an [io.Reader],
+// after verifying it was sized the same way as a.
+func (a *ApproxCache) Load(reader io.Reader) (e error) {
+	var (
+		count  uint64
+		header = make([]byte, len(approxSaveMagic))
+		k      uint64
+		m      uint64
+	)
+
+	_, e = io.ReadFull(reader, header)
+	if e != nil {
+		return
+	}
+
+	if string(header) != approxSaveMagic {
+		e = fmt.Errorf("could not load: not a Bloom cache")
+
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &m)
+	if e != nil {
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &k)
+	if e != nil {
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &count)
+	if e != nil {
+		return
+	}
+
+	a.mutex.Lock()
+
+	defer a.mutex.Unlock()
+
+	if m != a.m || k != a.k {
+		e = fmt.Errorf("could not load: filter not sized the same way as the cache it is loaded into")
+
+		return
+	}
+
+	_, e = io.ReadFull(reader, a.bits)
+	if e != nil {
+		return
+	}
+
+	a.count = int(count)
+
+	return
+}
+
+func (a *ApproxCache) hashes(value []byte) (h1 uint64, h2 uint64) {
+	// Derives two independent hashes of value, combined via double hashing
+	// (h1 + i*h2 mod m) to produce the k probe positions Insert and Recall
+	// need, without running k separate hash functions.
+
+	var (
+		buf = make([]byte, len(value)+1)
+	)
+
+	copy(buf[1:], value)
+
+	buf[0] = 0x00
+	h1 = xxhash.Sum64(buf)
+
+	buf[0] = 0xff
+	h2 = xxhash.Sum64(buf)
+
+	return
+}
+
+func (a *ApproxCache) bit(i uint64) bool {
+	return a.bits[i/bitsPerByte]&(1<<(i%bitsPerByte)) != 0
+}
+
+func (a *ApproxCache) setBit(i uint64) {
+	a.bits[i/bitsPerByte] |= 1 << (i % bitsPerByte)
+}
+
+func bloomBits(n uint64, falsePositiveRate float64) uint64 {
+	// m = -n*ln(p) / (ln2)^2, the number of bits minimizing the
+	// false-positive rate for n inserted values.
+
+	if n == 0 {
+		n = 1
+	}
+
+	var (
+		m = -float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)
+	)
+
+	return uint64(math.Ceil(m))
+}
+
+func bloomHashes(m uint64, n uint64) uint64 {
+	// k = (m/n)*ln2, the number of hash functions minimizing the
+	// false-positive rate for m bits holding n values.
+
+	if n == 0 {
+		n = 1
+	}
+
+	var (
+		k = (float64(m) / float64(n)) * math.Ln2
+	)
+
+	return uint64(math.Max(1, math.Round(k)))
+}
@@ -17,7 +17,9 @@ const (
 // segments of equal length, each representing a node in the tree.
 //
 // A node begins with a value of fixed length valLen, followed by two indices
-// of length idxLen pointing to its left and right children.
+// of length idxLen pointing to its left and right children. A Cache created
+// with PolicyLRU carries two further idxLen indices per node, threading an
+// intrusive doubly-linked list used to track recency of use.
 //
 // The Cache is insert-only and has a write lock to prevent concurrent writes.
 type Cache struct {
@@ -30,12 +32,38 @@ type Cache struct {
 	valLen int // length of values, in number of bytes
 
 	maxCap int // maximum number of values that can be cached
+
+	policy   Policy // eviction policy applied once the cache is full
+	balanced bool   // whether the tree is kept height-balanced (AVL)
+	root     int    // index of the root node
+	nextSlot int    // next never-before-used slot, for PolicyLRU
+	free     []int  // free-list of slots vacated by eviction, for PolicyLRU
+	head     int    // most-recently-used slot, for PolicyLRU; -1 if empty
+	tail     int    // least-recently-used slot, for PolicyLRU; -1 if empty
+	evicted  int    // number of values evicted over the cache's lifetime
 }
 
 // NewCache128 creates a new Cache that holds up to n 128-bit values in memory.
 // Allocates an array of maximum size 96 GiB if n == math.MaxUint32.
 func NewCache128(n uint32) *Cache {
-	return newCache(128, n)
+	return newCache(128, n, PolicyNone, false)
+}
+
+// NewCache creates a new Cache that holds up to n values of bitsPerValue
+// bits each, for callers whose fingerprints or hashes don't fit the fixed
+// 128-bit width NewCache128 hardcodes. bitsPerValue must be a multiple of 8.
+func NewCache(bitsPerValue uint16, n uint32) (c *Cache, e error) {
+	if bitsPerValue%bitsPerByte != 0 {
+		e = fmt.Errorf("could not create cache: bitsPerValue %d is not a multiple of %d",
+			bitsPerValue, bitsPerByte,
+		)
+
+		return
+	}
+
+	c = newCache(bitsPerValue, n, PolicyNone, false)
+
+	return
 }
 
 // Length returns the number of values currently cached.
@@ -48,14 +76,15 @@ func (c *Cache) Size() int {
 	return len(c.memory)
 }
 
-// Insert caches a value.
-func (c *Cache) Insert(value []byte) (e error) {
-	if c.length == c.maxCap {
-		e = fmt.Errorf("could not insert: no more free space left in cache")
-
-		return
-	}
+// Full returns true if the cache holds as many values as it can.
+func (c *Cache) Full() bool {
+	return c.length == c.maxCap
+}
 
+// Insert caches a value. If the cache is full and was created with
+// PolicyLRU, the least-recently-used value is evicted to make room;
+// otherwise Insert fails once the cache is full.
+func (c *Cache) Insert(value []byte) (e error) {
 	if len(value) != c.valLen {
 		e = fmt.Errorf("could not insert: value length not equal to %d bytes",
 			c.valLen,
@@ -68,12 +97,28 @@ func (c *Cache) Insert(value []byte) (e error) {
 
 	defer c.mutex.Unlock()
 
-	c.insert(0, value)
+	if c.length == c.maxCap {
+		if c.policy != PolicyLRU {
+			e = fmt.Errorf("could not insert: no more free space left in cache")
+
+			return
+		}
+
+		c.evictLRU()
+	}
+
+	if c.balanced {
+		c.insertBalanced(value)
+	} else {
+		c.insert(c.root, value)
+	}
 
 	return
 }
 
-// Recall returns true if a value has been cached, false otherwise.
+// Recall returns true if a value has been cached, false otherwise. For a
+// Cache created with PolicyLRU, recalling a value also marks it as
+// most-recently-used.
 func (c *Cache) Recall(value []byte) (cached bool, e error) {
 	if len(value) != c.valLen {
 		e = fmt.Errorf("could not recall: value length not equal to %d bytes",
@@ -83,11 +128,31 @@ func (c *Cache) Recall(value []byte) (cached bool, e error) {
 		return
 	}
 
-	return c.recall(0, value), nil
+	if c.policy == PolicyLRU {
+		c.mutex.Lock()
+
+		defer c.mutex.Unlock()
+	}
+
+	if c.balanced {
+		return c.recallBalanced(value), nil
+	}
+
+	return c.recall(c.root, value), nil
 }
 
 // Last returns the last-cached value, or an nil slice if the cache is empty.
+// For a Cache created with PolicyLRU, this is the most-recently-used value
+// rather than the most-recently-inserted one.
 func (c *Cache) Last() (value []byte) {
+	if c.policy == PolicyLRU {
+		if c.head == -1 {
+			return
+		}
+
+		return c.val(c.head)
+	}
+
 	switch c.length {
 	case 0:
 		return
@@ -100,7 +165,12 @@ func (c *Cache) Last() (value []byte) {
 }
 
 // Save writes all cached values to an [io.Writer] in the order of their
-// insertion, after sending metadata about value length and quantity.
+// insertion, after sending metadata about value length and quantity. For a
+// Cache created with PolicyLRU, values are streamed from least- to
+// most-recently-used instead, since eviction leaves slots out of order. For a
+// Cache created with NewCache128Balanced, values are streamed in slot order,
+// which is not insertion order once rotations have moved values between
+// slots.
 func (c *Cache) Save(writer io.Writer) (e error) {
 	var (
 		i int
@@ -124,6 +194,19 @@ func (c *Cache) Save(writer io.Writer) (e error) {
 		return
 	}
 
+	if c.policy == PolicyLRU {
+		for i = c.tail; i != -1; i = c.idxPrev(i) {
+			_, e = writer.Write(
+				c.val(i),
+			)
+			if e != nil {
+				return
+			}
+		}
+
+		return
+	}
+
 	for i = 0; i < c.length; i++ {
 		_, e = writer.Write(
 			c.val(i),
@@ -137,20 +220,33 @@ func (c *Cache) Save(writer io.Writer) (e error) {
 }
 
 // Counterpart to Save, Load reads and inserts values from an [io.Reader],
-// after verifying metadata about inbound value length and quantity.
+// after verifying metadata about inbound value length and quantity. It
+// sniffs the leading bytes to tell apart the original, uncompressed format
+// from the versioned, checksummed one written by SaveWithOptions.
 func (c *Cache) Load(reader io.Reader) (e error) {
 	var (
-		i      uint32
-		length uint32
-		valLen uint32
-		value  []byte
+		header = make([]byte, len(saveMagicV2))
 	)
 
-	e = binary.Read(reader, binary.BigEndian, &valLen)
+	_, e = io.ReadFull(reader, header)
 	if e != nil {
 		return
 	}
 
+	if string(header) == saveMagicV2 {
+		return c.loadV2(reader)
+	}
+
+	return c.loadV1(binary.BigEndian.Uint32(header), reader)
+}
+
+func (c *Cache) loadV1(valLen uint32, reader io.Reader) (e error) {
+	var (
+		i      uint32
+		length uint32
+		value  []byte
+	)
+
 	e = binary.Read(reader, binary.BigEndian, &length)
 	if e != nil {
 		return
@@ -182,20 +278,43 @@ func (c *Cache) Load(reader io.Reader) (e error) {
 			return
 		}
 
-		c.insert(0, value)
+		if c.balanced {
+			c.insertBalanced(value)
+		} else {
+			c.insert(c.root, value)
+		}
 	}
 
 	return
 }
 
-func newCache(l uint8, n uint32) (c *Cache) {
-	// Creates a new Cache that holds up to n l-bit values in memory.
+func newCache(l uint16, n uint32, policy Policy, balanced bool) (c *Cache) {
+	// Creates a new Cache that holds up to n l-bit values in memory, using
+	// policy to decide what happens once it is full and, if balanced, kept
+	// height-balanced as an AVL tree.
+
+	var (
+		bound = int(n)
+	)
+
+	if policy == PolicyLRU || balanced {
+		// One extra value of headroom so that a null index can be told
+		// apart from a real slot 0, once a node other than the original
+		// root can end up relocated there.
+		bound++
+	}
 
 	c = &Cache{
-		idxLen: log(int(n), bitsPerByte) / bitsPerByte,
+		idxLen: log(bound, bitsPerByte) / bitsPerByte,
 		valLen: int(l / bitsPerByte),
 
 		maxCap: int(n),
+
+		policy:   policy,
+		balanced: balanced,
+
+		head: -1,
+		tail: -1,
 	}
 
 	c.memory = make([]byte,
@@ -205,33 +324,83 @@ func newCache(l uint8, n uint32) (c *Cache) {
 	return
 }
 
+func (c *Cache) nullIdx() int {
+	// Returns the value used to mean "no such index" for child, prev and
+	// next pointers alike.
+
+	if c.policy == PolicyLRU || c.balanced {
+		return -1
+	}
+
+	return 0
+}
+
 func (c *Cache) insert(i int, val []byte) {
 	// Appends a new node to the array by setting its value, and updates its
 	// parent to point to it. Make sure this method is only called when the
 	// mutex is locked!
 
 	var (
-		left bool
-		next int
+		found bool
+		left  bool
+		next  int
+		slot  int
 	)
 
-	next, left = c.look(i, val)
+	if c.length == 0 {
+		if c.policy == PolicyLRU {
+			slot = c.allocSlot()
+		} else {
+			slot = c.length
+		}
+
+		c.setVal(slot, val)
+		c.setIdxL(slot, c.nullIdx())
+		c.setIdxR(slot, c.nullIdx())
+
+		c.root = slot
+		c.length++
+
+		if c.policy == PolicyLRU {
+			c.linkMRU(slot)
+		}
 
-	switch next {
-	case -1: // do nothing; value already cached
 		return
+	}
 
-	case 0: // child does not exist; create child
-		c.setVal(c.length, val)
+	next, found, left = c.look(i, val)
+
+	switch {
+	case found: // value already cached
+		if c.policy == PolicyLRU {
+			c.touch(i)
+		}
+
+		return
+
+	case next == c.nullIdx(): // child does not exist; create child
+		if c.policy == PolicyLRU {
+			slot = c.allocSlot()
+		} else {
+			slot = c.length
+		}
+
+		c.setVal(slot, val)
+		c.setIdxL(slot, c.nullIdx())
+		c.setIdxR(slot, c.nullIdx())
 
 		if left {
-			c.setIdxL(i, c.length)
+			c.setIdxL(i, slot)
 		} else {
-			c.setIdxR(i, c.length)
+			c.setIdxR(i, slot)
 		}
 
 		c.length++
 
+		if c.policy == PolicyLRU {
+			c.linkMRU(slot)
+		}
+
 	default: // child exists; descend into child
 		c.insert(next, val)
 	}
@@ -243,16 +412,21 @@ func (c *Cache) recall(i int, val []byte) bool {
 	// Returns true if a node with value val is found; otherwise false.
 
 	var (
-		next int
+		found bool
+		next  int
 	)
 
-	next, _ = c.look(i, val)
+	next, found, _ = c.look(i, val)
+
+	switch {
+	case found: // value found
+		if c.policy == PolicyLRU {
+			c.touch(i)
+		}
 
-	switch next {
-	case -1: // value found
 		return true
 
-	case 0: // value not found
+	case next == c.nullIdx(): // value not found
 		return false
 
 	default: // go deeper
@@ -260,27 +434,27 @@ func (c *Cache) recall(i int, val []byte) bool {
 	}
 }
 
-func (c *Cache) look(i int, val []byte) (int, bool) {
+func (c *Cache) look(i int, val []byte) (next int, found bool, left bool) {
 	// Returns either
 	// (1) the index of the left child of the i-th node in the array, if
 	//     val is less than the value of that node, or
 	// (2) the index of the right child, if val is greater, or
-	// (3) 0, if the relevant child does not exist, or
-	// (4) -1, if val is equal to the value of that node, and
+	// (3) nullIdx(), if the relevant child does not exist, and
+	// found is true if val equals the value of the i-th node, and left is
 	// true if the index returned is of the left child of that node.
 
 	switch bytes.Compare(c.val(i), val) {
 	case 0:
-		return -1, false
+		return c.nullIdx(), true, false
 
 	case 1: // c.val(i) > val
-		return c.idxL(i), true
+		return c.idxL(i), false, true
 
 	case -1: // c.val(i) < val
-		return c.idxR(i), false
+		return c.idxR(i), false, false
 	}
 
-	return 0, false
+	return c.nullIdx(), false, false
 }
 
 func (c *Cache) val(i int) []byte {
@@ -303,6 +477,10 @@ func (c *Cache) idxL(i int) int {
 
 	idxVal = getUint32(c.memory[idxPos : idxPos+c.idxLen])
 
+	if c.policy == PolicyLRU || c.balanced {
+		return int(idxVal) - 1
+	}
+
 	return int(idxVal)
 }
 
@@ -316,6 +494,10 @@ func (c *Cache) idxR(i int) int {
 
 	idxVal = getUint32(c.memory[idxPos : idxPos+c.idxLen])
 
+	if c.policy == PolicyLRU || c.balanced {
+		return int(idxVal) - 1
+	}
+
 	return int(idxVal)
 }
 
@@ -342,10 +524,15 @@ func (c *Cache) setIdxL(i int, idxVal int) {
 
 	var (
 		idxPos int = i*c.nodeLen() + c.valLen
+		raw    int = idxVal
 	)
 
+	if c.policy == PolicyLRU || c.balanced {
+		raw = idxVal + 1
+	}
+
 	putUint32(c.memory[idxPos:idxPos+c.idxLen],
-		uint32(idxVal),
+		uint32(raw),
 	)
 
 	return
@@ -357,10 +544,15 @@ func (c *Cache) setIdxR(i int, idxVal int) {
 
 	var (
 		idxPos int = i*c.nodeLen() + c.valLen + c.idxLen
+		raw    int = idxVal
 	)
 
+	if c.policy == PolicyLRU || c.balanced {
+		raw = idxVal + 1
+	}
+
 	putUint32(c.memory[idxPos:idxPos+c.idxLen],
-		uint32(idxVal),
+		uint32(raw),
 	)
 
 	return
@@ -369,7 +561,16 @@ func (c *Cache) setIdxR(i int, idxVal int) {
 func (c *Cache) nodeLen() int {
 	// Returns the length of a node, in number of bytes.
 
-	return c.valLen + 2*c.idxLen
+	switch {
+	case c.policy == PolicyLRU:
+		return c.valLen + 4*c.idxLen
+
+	case c.balanced:
+		return c.valLen + 2*c.idxLen + 1
+
+	default:
+		return c.valLen + 2*c.idxLen
+	}
 }
 
 func log(n int, m int) (x int) {
@@ -0,0 +1,418 @@
+package dejavu
+
+import (
+	"bytes"
+)
+
+// NewCache128Balanced creates a new Cache that holds up to n 128-bit values
+// in memory, kept height-balanced as an AVL tree so that Insert and Recall
+// are bounded to O(log n) depth regardless of insertion order.
+func NewCache128Balanced(n uint32) *Cache {
+	return newCache(128, n, PolicyNone, true)
+}
+
+// Depth returns the height of the tree, in number of edges from the root to
+// its deepest leaf, or 0 if the cache is empty. Only meaningful for a Cache
+// created with NewCache128Balanced.
+func (c *Cache) Depth() int {
+	if c.length == 0 {
+		return 0
+	}
+
+	return c.depth(c.root)
+}
+
+// Balance returns the balance factor of the root node: the height of its
+// right subtree minus the height of its left subtree. Only meaningful for a
+// Cache created with NewCache128Balanced, where it is always within [-1, 1].
+func (c *Cache) Balance() int {
+	if c.length == 0 {
+		return 0
+	}
+
+	// balanceFactor is stored and maintained internally as left minus
+	// right, since that is the convention retrace and rotate are written
+	// against; negate it here so the exported diagnostic matches its doc.
+	return -int(c.balanceFactor(c.root))
+}
+
+func (c *Cache) depth(i int) int {
+	// Returns the height of the subtree rooted at i, or -1 if it is empty.
+
+	if i == c.nullIdx() {
+		return -1
+	}
+
+	var (
+		l = c.depth(c.idxL(i))
+		r = c.depth(c.idxR(i))
+	)
+
+	if l > r {
+		return l + 1
+	}
+
+	return r + 1
+}
+
+func (c *Cache) insertBalanced(val []byte) {
+	// Inserts val into an AVL-balanced tree iteratively, then retraces the
+	// path back to the root to update balance factors and rotate where
+	// needed. Make sure this method is only called when the mutex is
+	// locked!
+
+	if c.length == 0 {
+		var (
+			slot = c.length
+		)
+
+		c.setVal(slot, val)
+		c.setIdxL(slot, c.nullIdx())
+		c.setIdxR(slot, c.nullIdx())
+		c.setBalanceFactor(slot, 0)
+
+		c.root = slot
+		c.length++
+
+		return
+	}
+
+	var (
+		path = make([]int, 0, c.depthBound())
+		i    = c.root
+		left bool
+	)
+
+	for {
+		var (
+			next  int
+			found bool
+		)
+
+		next, found, left = c.look(i, val)
+
+		if found { // value already cached
+			return
+		}
+
+		path = append(path, i)
+
+		if next == c.nullIdx() {
+			break
+		}
+
+		i = next
+	}
+
+	var (
+		slot = c.length
+	)
+
+	c.setVal(slot, val)
+	c.setIdxL(slot, c.nullIdx())
+	c.setIdxR(slot, c.nullIdx())
+	c.setBalanceFactor(slot, 0)
+
+	if left {
+		c.setIdxL(i, slot)
+	} else {
+		c.setIdxR(i, slot)
+	}
+
+	c.length++
+
+	c.retrace(path, val)
+}
+
+func (c *Cache) recallBalanced(val []byte) bool {
+	// Returns true if a node with value val is found; otherwise false.
+	// Walks down from the root iteratively, since the tree is kept shallow.
+
+	if c.length == 0 {
+		return false
+	}
+
+	var (
+		i = c.root
+	)
+
+	for i != c.nullIdx() {
+		var (
+			next  int
+			found bool
+		)
+
+		next, found, _ = c.look(i, val)
+
+		if found {
+			return true
+		}
+
+		i = next
+	}
+
+	return false
+}
+
+func (c *Cache) depthBound() int {
+	// Returns a depth the AVL tree can never exceed while holding at most
+	// maxCap values, used to size the path stack used by insertBalanced.
+
+	return 2 * (log(c.maxCap+1, 1) + 1)
+}
+
+func (c *Cache) retrace(path []int, val []byte) {
+	// Walks path from the newly-inserted leaf's parent back towards the
+	// root, updating balance factors and rotating subtrees that have
+	// become unbalanced. Stops as soon as a subtree's height is found not
+	// to have grown, since nothing above it needs adjusting either.
+
+	var (
+		idx int
+	)
+
+	for idx = len(path) - 1; idx >= 0; idx-- {
+		var (
+			node = path[idx]
+			bf   = int(c.balanceFactor(node))
+		)
+
+		switch bytes.Compare(c.val(node), val) {
+		case 1: // val went into the left subtree
+			bf++
+
+		default: // val went into the right subtree
+			bf--
+		}
+
+		switch {
+		case bf == 0:
+			c.setBalanceFactor(node, int8(bf))
+
+			return
+
+		case bf == 1 || bf == -1:
+			c.setBalanceFactor(node, int8(bf))
+
+		default:
+			c.rotate(node, bf)
+
+			return
+		}
+	}
+
+	return
+}
+
+func (c *Cache) rotate(node int, bf int) {
+	// Rebalances the subtree rooted at node, whose balance factor bf is
+	// +-2. Rotations are carried out by rewriting the value, children and
+	// balance factor of the slots involved rather than relinking pointers,
+	// so that slot node always ends up holding the subtree's new root and
+	// no index held by an ancestor (or by the Cache itself, for the root)
+	// ever needs to change.
+
+	if bf == 2 {
+		var (
+			l = c.idxL(node)
+		)
+
+		if c.balanceFactor(l) >= 0 {
+			c.rotateRight(node, l)
+		} else {
+			c.rotateLeftRight(node, l)
+		}
+
+		return
+	}
+
+	var (
+		r = c.idxR(node)
+	)
+
+	if c.balanceFactor(r) <= 0 {
+		c.rotateLeft(node, r)
+	} else {
+		c.rotateRightLeft(node, r)
+	}
+
+	return
+}
+
+func (c *Cache) rotateRight(a int, b int) {
+	// Single right rotation: b is a's left child. Afterwards, slot a holds
+	// what was b's subtree, and slot b holds what was a's subtree, demoted
+	// to a's right child.
+
+	var (
+		valA = append([]byte(nil), c.val(a)...)
+		valB = append([]byte(nil), c.val(b)...)
+		bl   = c.idxL(b)
+		br   = c.idxR(b)
+		ar   = c.idxR(a)
+		lbf  = c.balanceFactor(b)
+	)
+
+	c.setVal(a, valB)
+	c.setIdxL(a, bl)
+	c.setIdxR(a, b)
+
+	c.setVal(b, valA)
+	c.setIdxL(b, br)
+	c.setIdxR(b, ar)
+
+	if lbf == 0 { // never happens from insertion alone; handled for completeness
+		c.setBalanceFactor(a, -1)
+		c.setBalanceFactor(b, 1)
+	} else {
+		c.setBalanceFactor(a, 0)
+		c.setBalanceFactor(b, 0)
+	}
+
+	return
+}
+
+func (c *Cache) rotateLeft(a int, b int) {
+	// Single left rotation: b is a's right child. Mirrors rotateRight.
+
+	var (
+		valA = append([]byte(nil), c.val(a)...)
+		valB = append([]byte(nil), c.val(b)...)
+		bl   = c.idxL(b)
+		br   = c.idxR(b)
+		al   = c.idxL(a)
+		rbf  = c.balanceFactor(b)
+	)
+
+	c.setVal(a, valB)
+	c.setIdxR(a, br)
+	c.setIdxL(a, b)
+
+	c.setVal(b, valA)
+	c.setIdxR(b, bl)
+	c.setIdxL(b, al)
+
+	if rbf == 0 {
+		c.setBalanceFactor(a, 1)
+		c.setBalanceFactor(b, -1)
+	} else {
+		c.setBalanceFactor(a, 0)
+		c.setBalanceFactor(b, 0)
+	}
+
+	return
+}
+
+func (c *Cache) rotateLeftRight(a int, b int) {
+	// Double rotation: b is a's left child, and d is b's right child. Slot
+	// a ends up holding d's old subtree; b and d are repurposed to hold
+	// the rest, but keep their own identity since nothing but a (and,
+	// through it, the tree itself) ever points at them directly.
+
+	var (
+		d    = c.idxR(b)
+		valA = append([]byte(nil), c.val(a)...)
+		valD = append([]byte(nil), c.val(d)...)
+		dl   = c.idxL(d)
+		dr   = c.idxR(d)
+		ar   = c.idxR(a)
+		dbf  = c.balanceFactor(d)
+	)
+
+	c.setIdxR(b, dl)
+
+	c.setVal(d, valA)
+	c.setIdxL(d, dr)
+	c.setIdxR(d, ar)
+
+	c.setVal(a, valD)
+	c.setIdxL(a, b)
+	c.setIdxR(a, d)
+
+	switch dbf {
+	case 1:
+		c.setBalanceFactor(b, 0)
+		c.setBalanceFactor(d, -1)
+
+	case -1:
+		c.setBalanceFactor(b, 1)
+		c.setBalanceFactor(d, 0)
+
+	default:
+		c.setBalanceFactor(b, 0)
+		c.setBalanceFactor(d, 0)
+	}
+
+	c.setBalanceFactor(a, 0)
+
+	return
+}
+
+func (c *Cache) rotateRightLeft(a int, b int) {
+	// Double rotation: b is a's right child, and d is b's left child.
+	// Mirrors rotateLeftRight.
+
+	var (
+		d    = c.idxL(b)
+		valA = append([]byte(nil), c.val(a)...)
+		valD = append([]byte(nil), c.val(d)...)
+		dl   = c.idxL(d)
+		dr   = c.idxR(d)
+		al   = c.idxL(a)
+		dbf  = c.balanceFactor(d)
+	)
+
+	c.setIdxL(b, dr)
+
+	c.setVal(d, valA)
+	c.setIdxR(d, dl)
+	c.setIdxL(d, al)
+
+	c.setVal(a, valD)
+	c.setIdxR(a, b)
+	c.setIdxL(a, d)
+
+	switch dbf {
+	case -1:
+		c.setBalanceFactor(b, 1)
+		c.setBalanceFactor(d, 0)
+
+	case 1:
+		c.setBalanceFactor(b, 0)
+		c.setBalanceFactor(d, -1)
+
+	default:
+		c.setBalanceFactor(b, 0)
+		c.setBalanceFactor(d, 0)
+	}
+
+	c.setBalanceFactor(a, 0)
+
+	return
+}
+
+func (c *Cache) balanceFactor(i int) int8 {
+	// Returns the internal balance factor of the i-th node: the height of
+	// its left subtree minus the height of its right subtree. retrace and
+	// rotate are both written against this convention; Balance negates it
+	// to expose the more conventional right-minus-left to callers.
+
+	var (
+		balPos = i*c.nodeLen() + c.valLen + 2*c.idxLen
+	)
+
+	return int8(c.memory[balPos])
+}
+
+func (c *Cache) setBalanceFactor(i int, bf int8) {
+	// Overwrites the balance factor of the i-th node.
+	// Ensure it is only called while the mutex is locked!
+
+	var (
+		balPos = i*c.nodeLen() + c.valLen + 2*c.idxLen
+	)
+
+	c.memory[balPos] = byte(bf)
+
+	return
+}
@@ -0,0 +1,312 @@
+package dejavu
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// A Policy controls what a Cache does once it is asked to Insert a value
+// while already holding maxCap values.
+type Policy uint8
+
+const (
+	// PolicyNone rejects an Insert once the cache is full.
+	PolicyNone Policy = iota
+
+	// PolicyLRU evicts the least-recently-used value to make room for the
+	// newly inserted one once the cache is full.
+	PolicyLRU
+)
+
+// NewCache128WithPolicy creates a new Cache that holds up to n 128-bit
+// values in memory, applying policy once it is full.
+func NewCache128WithPolicy(n uint32, policy Policy) *Cache {
+	return newCache(128, n, policy, false)
+}
+
+// Capacity returns the maximum number of values the cache can hold.
+func (c *Cache) Capacity() int {
+	return c.maxCap
+}
+
+// Evicted returns the number of values evicted from the cache over its
+// lifetime to make room for newly inserted ones. Always zero unless the
+// cache was created with PolicyLRU.
+func (c *Cache) Evicted() int {
+	return c.evicted
+}
+
+// SetCapacity grows or shrinks the cache's capacity. Shrinking below the
+// number of values currently cached evicts the least-recently-used ones
+// immediately to make room. Only valid for a Cache created with PolicyLRU.
+//
+// Growing is rejected once n would no longer fit in the byte width idxLen
+// was fixed to at creation: idxLen is sized once, from the cache's original
+// capacity, and widening it in place would require migrating every index
+// already encoded at the old width.
+func (c *Cache) SetCapacity(n uint32) (e error) {
+	if c.policy != PolicyLRU {
+		e = fmt.Errorf("could not set capacity: cache does not use an eviction policy")
+
+		return
+	}
+
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	switch {
+	case int(n) > c.maxCap:
+		if uint64(n) > maxIdxValue(c.idxLen) {
+			e = fmt.Errorf("could not set capacity: %d would exceed the %d-byte index width chosen at creation",
+				n, c.idxLen,
+			)
+
+			return
+		}
+
+		c.memory = append(c.memory,
+			make([]byte, (int(n)-c.maxCap)*c.nodeLen())...,
+		)
+
+	case int(n) < c.maxCap:
+		for c.length > int(n) {
+			c.evictLRU()
+		}
+	}
+
+	c.maxCap = int(n)
+
+	return
+}
+
+func maxIdxValue(idxLen int) uint64 {
+	// Returns the largest value representable in idxLen bytes, the same
+	// width putUint32/getUint32 encode child/prev/next indices in.
+
+	return 1<<(8*uint(idxLen)) - 1
+}
+
+func (c *Cache) allocSlot() int {
+	// Returns a slot to store a new node in, preferring one vacated by a
+	// past eviction over growing into a never-before-used one.
+
+	var (
+		n = len(c.free)
+	)
+
+	if n > 0 {
+		var (
+			slot = c.free[n-1]
+		)
+
+		c.free = c.free[:n-1]
+
+		return slot
+	}
+
+	var (
+		slot = c.nextSlot
+	)
+
+	c.nextSlot++
+
+	return slot
+}
+
+func (c *Cache) linkMRU(slot int) {
+	// Inserts slot at the most-recently-used end of the LRU list.
+	// Ensure it is only called while the mutex is locked!
+
+	c.setIdxPrev(slot, c.nullIdx())
+	c.setIdxNext(slot, c.head)
+
+	if c.head != -1 {
+		c.setIdxPrev(c.head, slot)
+	}
+
+	c.head = slot
+
+	if c.tail == -1 {
+		c.tail = slot
+	}
+
+	return
+}
+
+func (c *Cache) unlink(slot int) {
+	// Removes slot from wherever it currently sits in the LRU list.
+	// Ensure it is only called while the mutex is locked!
+
+	var (
+		prev = c.idxPrev(slot)
+		next = c.idxNext(slot)
+	)
+
+	if prev != -1 {
+		c.setIdxNext(prev, next)
+	} else {
+		c.head = next
+	}
+
+	if next != -1 {
+		c.setIdxPrev(next, prev)
+	} else {
+		c.tail = prev
+	}
+
+	return
+}
+
+func (c *Cache) touch(slot int) {
+	// Moves slot to the most-recently-used end of the LRU list.
+	// Ensure it is only called while the mutex is locked!
+
+	if c.head == slot {
+		return
+	}
+
+	c.unlink(slot)
+	c.linkMRU(slot)
+
+	return
+}
+
+func (c *Cache) evictLRU() {
+	// Removes the least-recently-used value from the cache, freeing its
+	// slot for reuse. Ensure it is only called while the mutex is locked!
+
+	var (
+		slot = c.tail
+		val  = make([]byte, c.valLen)
+	)
+
+	copy(val, c.val(slot))
+
+	c.unlink(slot)
+
+	c.root = c.remove(c.root, val)
+
+	c.length--
+
+	c.evicted++
+
+	return
+}
+
+func (c *Cache) remove(i int, val []byte) int {
+	// Deletes the node holding val from the subtree rooted at i, returning
+	// the (possibly new) root of that subtree. A node's slot is only ever
+	// handed back to the free-list once val has actually left the subtree,
+	// so surviving nodes never change slot and external indices into them
+	// stay valid.
+
+	if i == c.nullIdx() {
+		return i
+	}
+
+	switch bytes.Compare(c.val(i), val) {
+	case 1: // c.val(i) > val
+		c.setIdxL(i, c.remove(c.idxL(i), val))
+
+	case -1: // c.val(i) < val
+		c.setIdxR(i, c.remove(c.idxR(i), val))
+
+	default: // found
+		var (
+			l = c.idxL(i)
+			r = c.idxR(i)
+		)
+
+		switch {
+		case l == c.nullIdx():
+			c.free = append(c.free, i)
+
+			return r
+
+		case r == c.nullIdx():
+			c.free = append(c.free, i)
+
+			return l
+
+		default:
+			var (
+				parent = i
+				succ   = r
+			)
+
+			for c.idxL(succ) != c.nullIdx() {
+				parent = succ
+				succ = c.idxL(succ)
+			}
+
+			if parent != i {
+				c.setIdxL(parent, c.idxR(succ))
+				c.setIdxR(succ, r)
+			}
+
+			c.setIdxL(succ, l)
+			c.free = append(c.free, i)
+
+			return succ
+		}
+	}
+
+	return i
+}
+
+func (c *Cache) idxPrev(i int) int {
+	// Returns the index of the previous node (towards MRU) in the LRU list.
+
+	var (
+		idxPos int = i*c.nodeLen() + c.valLen + 2*c.idxLen
+		idxVal uint32
+	)
+
+	idxVal = getUint32(c.memory[idxPos : idxPos+c.idxLen])
+
+	return int(idxVal) - 1
+}
+
+func (c *Cache) idxNext(i int) int {
+	// Returns the index of the next node (towards LRU) in the LRU list.
+
+	var (
+		idxPos int = i*c.nodeLen() + c.valLen + 3*c.idxLen
+		idxVal uint32
+	)
+
+	idxVal = getUint32(c.memory[idxPos : idxPos+c.idxLen])
+
+	return int(idxVal) - 1
+}
+
+func (c *Cache) setIdxPrev(i int, idxVal int) {
+	// Overwrites the index of the previous node in the LRU list.
+	// Ensure it is only called while the mutex is locked!
+
+	var (
+		idxPos int = i*c.nodeLen() + c.valLen + 2*c.idxLen
+	)
+
+	putUint32(c.memory[idxPos:idxPos+c.idxLen],
+		uint32(idxVal+1),
+	)
+
+	return
+}
+
+func (c *Cache) setIdxNext(i int, idxVal int) {
+	// Overwrites the index of the next node in the LRU list.
+	// Ensure it is only called while the mutex is locked!
+
+	var (
+		idxPos int = i*c.nodeLen() + c.valLen + 3*c.idxLen
+	)
+
+	putUint32(c.memory[idxPos:idxPos+c.idxLen],
+		uint32(idxVal+1),
+	)
+
+	return
+}
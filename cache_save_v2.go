@@ -0,0 +1,343 @@
+package dejavu
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	saveMagicV2   = "DJV1"
+	saveVersionV2 = 1
+)
+
+// A Compression identifies the algorithm SaveWithOptions uses to compress
+// the values it writes.
+type Compression uint8
+
+const (
+	// CompressionNone writes values uncompressed.
+	CompressionNone Compression = iota
+
+	// CompressionSnappy compresses values with Snappy, favouring speed.
+	CompressionSnappy
+
+	// CompressionZSTD compresses values with zstd, favouring ratio.
+	CompressionZSTD
+)
+
+// SaveOptions configures SaveWithOptions.
+type SaveOptions struct {
+	Compression Compression
+	Level       int // only consulted for CompressionZSTD; higher compresses harder
+}
+
+// SaveWithOptions writes all cached values to an [io.Writer], as Save does,
+// but behind a versioned header identifying a compression algorithm and a
+// CRC32C of the uncompressed payload, so Load can verify its integrity.
+//
+// The compressed payload is length-prefixed so Load can bound how much of
+// the stream it hands to the decompressor: zstd in particular treats its
+// input as a stream of concatenated frames and will otherwise read past the
+// end of this one looking for the next, consuming the trailing CRC32C.
+func (c *Cache) SaveWithOptions(writer io.Writer, opts SaveOptions) (e error) {
+	var (
+		compressed bytes.Buffer
+		crc        = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		dst        io.Writer
+		i          int
+		lenBuf     = make([]byte, binary.MaxVarintLen64)
+		n          int
+		payload    io.WriteCloser
+	)
+
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	_, e = io.WriteString(writer, saveMagicV2)
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, uint8(saveVersionV2))
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, uint8(opts.Compression))
+	if e != nil {
+		return
+	}
+
+	n = binary.PutUvarint(lenBuf, uint64(c.valLen))
+
+	_, e = writer.Write(lenBuf[:n])
+	if e != nil {
+		return
+	}
+
+	n = binary.PutUvarint(lenBuf, uint64(c.length))
+
+	_, e = writer.Write(lenBuf[:n])
+	if e != nil {
+		return
+	}
+
+	payload, e = newCompressWriter(&compressed, opts)
+	if e != nil {
+		return
+	}
+
+	dst = io.MultiWriter(payload, crc)
+
+	if c.policy == PolicyLRU {
+		for i = c.tail; i != -1; i = c.idxPrev(i) {
+			_, e = dst.Write(c.val(i))
+			if e != nil {
+				return
+			}
+		}
+	} else {
+		for i = 0; i < c.length; i++ {
+			_, e = dst.Write(c.val(i))
+			if e != nil {
+				return
+			}
+		}
+	}
+
+	e = payload.Close()
+	if e != nil {
+		return
+	}
+
+	n = binary.PutUvarint(lenBuf, uint64(compressed.Len()))
+
+	_, e = writer.Write(lenBuf[:n])
+	if e != nil {
+		return
+	}
+
+	_, e = writer.Write(compressed.Bytes())
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, crc.Sum32())
+
+	return
+}
+
+func (c *Cache) loadV2(reader io.Reader) (e error) {
+	var (
+		compression uint8
+		crc         = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		i           uint64
+		length      uint64
+		payload     io.ReadCloser
+		payloadLen  uint64
+		valLen      uint64
+		value       []byte
+		version     uint8
+		wantCRC     uint32
+	)
+
+	e = binary.Read(reader, binary.BigEndian, &version)
+	if e != nil {
+		return
+	}
+
+	if version != saveVersionV2 {
+		e = fmt.Errorf("could not load: unsupported format version %d", version)
+
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &compression)
+	if e != nil {
+		return
+	}
+
+	valLen, e = binary.ReadUvarint(newByteReader(reader))
+	if e != nil {
+		return
+	}
+
+	length, e = binary.ReadUvarint(newByteReader(reader))
+	if e != nil {
+		return
+	}
+
+	payloadLen, e = binary.ReadUvarint(newByteReader(reader))
+	if e != nil {
+		return
+	}
+
+	c.mutex.Lock()
+
+	defer c.mutex.Unlock()
+
+	if int(valLen) != c.valLen {
+		e = fmt.Errorf("could not load: value length not equal to %d bytes",
+			c.valLen,
+		)
+
+		return
+	}
+
+	if int(length) > (c.maxCap - c.length) {
+		e = fmt.Errorf("could not load: not enough free space left in cache")
+
+		return
+	}
+
+	payload, e = newDecompressReader(
+		io.LimitReader(reader, int64(payloadLen)),
+		Compression(compression),
+	)
+	if e != nil {
+		return
+	}
+
+	var (
+		tee = io.TeeReader(payload, crc)
+	)
+
+	value = make([]byte, valLen)
+
+	for i = 0; i < length; i++ {
+		_, e = io.ReadFull(tee, value)
+		if e != nil {
+			return
+		}
+
+		if c.balanced {
+			c.insertBalanced(value)
+		} else {
+			c.insert(c.root, value)
+		}
+	}
+
+	e = payload.Close()
+	if e != nil {
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &wantCRC)
+	if e != nil {
+		return
+	}
+
+	if wantCRC != crc.Sum32() {
+		e = fmt.Errorf("could not load: checksum mismatch")
+
+		return
+	}
+
+	return
+}
+
+func newCompressWriter(w io.Writer, opts SaveOptions) (io.WriteCloser, error) {
+	switch opts.Compression {
+	case CompressionNone:
+		return nopWriteCloser{w}, nil
+
+	case CompressionSnappy:
+		return snappy.NewBufferedWriter(w), nil
+
+	case CompressionZSTD:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstdLevel(opts.Level)))
+
+	default:
+		return nil, fmt.Errorf("could not save: unknown compression %d", opts.Compression)
+	}
+}
+
+func newDecompressReader(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	switch compression {
+	case CompressionNone:
+		return io.NopCloser(r), nil
+
+	case CompressionSnappy:
+		return io.NopCloser(snappy.NewReader(r)), nil
+
+	case CompressionZSTD:
+		zr, e := zstd.NewReader(r)
+		if e != nil {
+			return nil, e
+		}
+
+		return zstdReadCloser{zr}, nil
+
+	default:
+		return nil, fmt.Errorf("could not load: unknown compression %d", compression)
+	}
+}
+
+func zstdLevel(level int) zstd.EncoderLevel {
+	// Maps the roughly gzip-shaped 1..22 levels callers tend to reach for
+	// onto zstd's own small set of named speed/ratio tradeoffs.
+
+	switch {
+	case level <= 1:
+		return zstd.SpeedFastest
+
+	case level <= 3:
+		return zstd.SpeedDefault
+
+	case level <= 9:
+		return zstd.SpeedBetterCompression
+
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+
+	return nil
+}
+
+func newByteReader(r io.Reader) io.ByteReader {
+	if br, ok := r.(io.ByteReader); ok {
+		return br
+	}
+
+	return &singleByteReader{r: r}
+}
+
+// A singleByteReader adapts an [io.Reader] into an [io.ByteReader] by
+// reading one byte at a time, for callers (like binary.ReadUvarint) that
+// need one but may be handed a plain reader.
+type singleByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (s *singleByteReader) ReadByte() (byte, error) {
+	_, e := io.ReadFull(s.r, s.buf[:])
+	if e != nil {
+		return 0, e
+	}
+
+	return s.buf[0], nil
+}
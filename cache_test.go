@@ -2,7 +2,9 @@ package dejavu
 
 import (
 	"bytes"
+	"encoding/binary"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -225,6 +227,960 @@ func BenchmarkCacheRecall(b *testing.B) {
 	return
 }
 
+func TestShardedCache(t *testing.T) {
+	const (
+		nCases = 1 << 8 // 256
+		shards = 4
+	)
+
+	var (
+		buffer bytes.Buffer
+		cache0 *ShardedCache
+		cache1 *ShardedCache
+		e      error
+		found  bool
+		i      int
+	)
+
+	cache0, e = NewShardedCache128(nCases, shards)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, shards,
+		cache0.Shards(),
+	)
+
+	for i = 0; i < nCases; i++ {
+		e = cache0.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	assert.Equal(t, nCases,
+		cache0.Length(),
+	)
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache0.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	found, e = cache0.Recall(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, found)
+
+	e = cache0.Save(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	cache1, e = NewShardedCache128(nCases, shards)
+	if e != nil {
+		t.Error(e)
+	}
+
+	e = cache1.Load(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache1.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	_, e = NewShardedCache128(nCases, 3)
+
+	assert.NotNil(t, e)
+
+	return
+}
+
+func TestShardedCacheManyShards(t *testing.T) {
+	// Exercises shard counts above 256, where shardBits > 8 and routing
+	// must read more than just the leading byte of a value.
+	const (
+		nCases = 1 << 11 // 2048
+		shards = 512
+	)
+
+	var (
+		cache *ShardedCache
+		e     error
+		found bool
+		i     int
+		seen  = make(map[int]bool)
+	)
+
+	cache, e = NewShardedCache128(uint32(nCases), shards)
+	if e != nil {
+		t.Error(e)
+	}
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		seen[cache.shard(values[i])] = true
+	}
+
+	assert.Greater(t, len(seen), 1)
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
+func TestShardedCacheConcurrent(t *testing.T) {
+	const (
+		nCases  = 1 << 12
+		shards  = 8
+		workers = 16
+	)
+
+	var (
+		cache *ShardedCache
+		e     error
+		i     int
+		wg    sync.WaitGroup
+	)
+
+	cache, e = NewShardedCache128(nCases, shards)
+	if e != nil {
+		t.Error(e)
+	}
+
+	wg.Add(workers)
+
+	for i = 0; i < workers; i++ {
+		go func(worker int) {
+			defer wg.Done()
+
+			var (
+				j    int
+				werr error
+			)
+
+			for j = worker; j < nCases; j += workers {
+				werr = cache.Insert(values[j])
+				if werr != nil {
+					t.Error(werr)
+				}
+
+				_, werr = cache.Recall(values[j])
+				if werr != nil {
+					t.Error(werr)
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	assert.Equal(t, nCases,
+		cache.Length(),
+	)
+
+	return
+}
+
+func TestCacheWithPolicyLRU(t *testing.T) {
+	const (
+		nCases = 8
+	)
+
+	var (
+		cache *Cache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	assert.True(t, cache.Full())
+
+	assert.Equal(t, 0,
+		cache.Evicted(),
+	)
+
+	// Recalling values[0] makes it most-recently-used, so values[1] becomes
+	// the next value evicted instead.
+	found, e = cache.Recall(values[0])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	e = cache.Insert(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, 1,
+		cache.Evicted(),
+	)
+
+	assert.Equal(t, nCases,
+		cache.Length(),
+	)
+
+	found, e = cache.Recall(values[0])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	found, e = cache.Recall(values[1])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, found)
+
+	found, e = cache.Recall(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	return
+}
+
+func TestCacheWithPolicyLRURepeatedEviction(t *testing.T) {
+	// Inserting many more values than the cache can hold forces every slot
+	// to be freed and reused by eviction several times over. A reused slot
+	// must not keep the stale child pointers of whatever it held before, or
+	// the tree grows a cycle and Recall never returns.
+
+	const (
+		nCases = 8
+		nTotal = nCases * 20
+	)
+
+	var (
+		cache *Cache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	for i = 0; i < nTotal; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	assert.Equal(t, nTotal-nCases,
+		cache.Evicted(),
+	)
+
+	for i = 0; i < nTotal-nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.False(t, found)
+	}
+
+	for i = nTotal - nCases; i < nTotal; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
+func TestCacheWithPolicyLRUSaveLoad(t *testing.T) {
+	const (
+		nCases = 10
+	)
+
+	var (
+		buffer bytes.Buffer
+		cache0 *Cache
+		cache1 *Cache
+		e      error
+		found  bool
+		i      int
+	)
+
+	cache0 = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	for i = 0; i < nCases; i++ {
+		e = cache0.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	e = cache0.Save(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	cache1 = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	e = cache1.Load(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache1.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	buffer.Reset()
+
+	cache0 = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	for i = 0; i < nCases; i++ {
+		e = cache0.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	e = cache0.SaveWithOptions(&buffer, SaveOptions{Compression: CompressionNone})
+	if e != nil {
+		t.Error(e)
+	}
+
+	cache1 = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	e = cache1.Load(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache1.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
+func TestCacheSetCapacity(t *testing.T) {
+	const (
+		nCases = 8
+	)
+
+	var (
+		cache *Cache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	e = cache.SetCapacity(nCases / 2)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, nCases/2,
+		cache.Capacity(),
+	)
+
+	assert.Equal(t, nCases/2,
+		cache.Length(),
+	)
+
+	assert.Equal(t, nCases/2,
+		cache.Evicted(),
+	)
+
+	for i = 0; i < nCases/2; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.False(t, found)
+	}
+
+	for i = nCases / 2; i < nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	e = cache.SetCapacity(nCases)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, cache.Full())
+
+	e = cache.Insert(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, nCases/2+1,
+		cache.Length(),
+	)
+
+	return
+}
+
+func TestCacheSetCapacityRejectsOutgrowingIdxWidth(t *testing.T) {
+	const (
+		nCases = 200 // small enough that idxLen is fixed at 1 byte
+	)
+
+	var (
+		cache *Cache
+		e     error
+	)
+
+	cache = NewCache128WithPolicy(nCases, PolicyLRU)
+
+	e = cache.SetCapacity(1 << 20)
+
+	assert.NotNil(t, e)
+
+	assert.Equal(t, nCases,
+		cache.Capacity(),
+	)
+
+	return
+}
+
+func TestCacheBalanceSign(t *testing.T) {
+	// Balance is documented as right-minus-left; use two fixed values
+	// (rather than random ones) so which one sorts higher is known, and
+	// the sign of an unambiguously right-heavy tree can be checked.
+	var (
+		cache *Cache
+		e     error
+		hi    = make([]byte, 16)
+		lo    = make([]byte, 16)
+	)
+
+	binary.BigEndian.PutUint64(lo[8:], 1)
+	binary.BigEndian.PutUint64(hi[8:], 2)
+
+	cache = NewCache128Balanced(4)
+
+	e = cache.Insert(lo)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, 0, cache.Balance())
+
+	e = cache.Insert(hi)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, 1, cache.Balance())
+
+	return
+}
+
+func TestCacheBalanced(t *testing.T) {
+	const (
+		nCases = 1 << 10
+	)
+
+	var (
+		cache *Cache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewCache128Balanced(nCases)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.LessOrEqual(t,
+			cache.Depth(), 2*log(cache.Length()+1, 1)+2,
+		)
+
+		assert.GreaterOrEqual(t, cache.Balance(), -1)
+		assert.LessOrEqual(t, cache.Balance(), 1)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
+func TestCacheBalancedSortedInsert(t *testing.T) {
+	// A naive BST degenerates into a linked list when fed pre-sorted
+	// input; a balanced Cache must not.
+	const (
+		nCases = 1 << 12
+	)
+
+	var (
+		cache *Cache
+		e     error
+		i     int
+		value []byte
+	)
+
+	cache = NewCache128Balanced(nCases)
+
+	for i = 0; i < nCases; i++ {
+		value = make([]byte, 16)
+		binary.BigEndian.PutUint64(value[8:], uint64(i))
+
+		e = cache.Insert(value)
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	assert.LessOrEqual(t, cache.Depth(), 2*log(nCases, 1))
+
+	return
+}
+
+func BenchmarkCacheInsertSorted(b *testing.B) {
+	var (
+		cache *Cache
+		e     error
+		i     int
+		value []byte
+	)
+
+	cache = NewCache128Balanced(uint32(b.N + 1))
+
+	b.ResetTimer()
+
+	for i = 0; i < b.N; i++ {
+		value = make([]byte, 16)
+		binary.BigEndian.PutUint64(value[8:], uint64(i))
+
+		e = cache.Insert(value)
+		if e != nil {
+			b.Error(e)
+		}
+	}
+
+	return
+}
+
+func TestCacheSaveWithOptions(t *testing.T) {
+	const (
+		nCases = 1 << 8 // 256
+	)
+
+	var (
+		buffer      bytes.Buffer
+		cache0      *Cache
+		cache1      *Cache
+		compression Compression
+		e           error
+		found       bool
+		i           int
+	)
+
+	for _, compression = range []Compression{
+		CompressionNone,
+		CompressionSnappy,
+		CompressionZSTD,
+	} {
+		buffer.Reset()
+
+		cache0 = NewCache128(nCases)
+
+		for i = 0; i < nCases; i++ {
+			e = cache0.Insert(values[i])
+			if e != nil {
+				t.Error(e)
+			}
+		}
+
+		e = cache0.SaveWithOptions(&buffer, SaveOptions{
+			Compression: compression,
+			Level:       3,
+		})
+		if e != nil {
+			t.Error(e)
+		}
+
+		cache1 = NewCache128(nCases)
+
+		e = cache1.Load(&buffer)
+		if e != nil {
+			t.Error(e)
+		}
+
+		for i = 0; i < nCases; i++ {
+			found, e = cache1.Recall(values[i])
+			if e != nil {
+				t.Error(e)
+			}
+
+			assert.True(t, found)
+		}
+	}
+
+	return
+}
+
+func TestCacheLoadChecksumMismatch(t *testing.T) {
+	const (
+		nCases = 1 << 4
+	)
+
+	var (
+		buffer bytes.Buffer
+		cache0 *Cache
+		cache1 *Cache
+		e      error
+		i      int
+		raw    []byte
+	)
+
+	cache0 = NewCache128(nCases)
+
+	for i = 0; i < nCases; i++ {
+		e = cache0.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	e = cache0.SaveWithOptions(&buffer, SaveOptions{Compression: CompressionNone})
+	if e != nil {
+		t.Error(e)
+	}
+
+	raw = buffer.Bytes()
+	raw[len(raw)-1] ^= 0xff // corrupt the trailing CRC32C
+
+	cache1 = NewCache128(nCases)
+
+	e = cache1.Load(bytes.NewReader(raw))
+
+	assert.NotNil(t, e)
+
+	return
+}
+
+func TestRingCache(t *testing.T) {
+	const (
+		nCases = 8
+	)
+
+	var (
+		cache *RingCache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewRingCache128(nCases)
+
+	assert.Equal(t, 0,
+		cache.Length(),
+	)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.Equal(t, i+1,
+			cache.Length(),
+		)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	// Inserting one more value evicts the oldest, wrapping the ring around.
+	e = cache.Insert(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, nCases,
+		cache.Length(),
+	)
+
+	found, e = cache.Recall(values[0])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, found)
+
+	found, e = cache.Recall(values[nCases])
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	return
+}
+
+func TestRingCacheRecallWithin(t *testing.T) {
+	const (
+		nCases = 8
+	)
+
+	var (
+		cache *RingCache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewRingCache128(nCases)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	found, e = cache.RecallWithin(values[0], 1)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, found)
+
+	found, e = cache.RecallWithin(values[0], uint64(nCases))
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	found, e = cache.RecallWithin(values[nCases-1], 1)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.True(t, found)
+
+	found, e = cache.RecallWithin(values[nCases], 1)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.False(t, found)
+
+	return
+}
+
+func TestNewCache(t *testing.T) {
+	const (
+		nCases = 8
+	)
+
+	var (
+		cache    *Cache
+		e        error
+		found    bool
+		i        int
+		value    []byte
+		values64 [][]byte = make([][]byte, nCases)
+	)
+
+	cache, e = NewCache(64, nCases)
+	if e != nil {
+		t.Error(e)
+	}
+
+	assert.Equal(t, 8, cache.valLen)
+
+	for i = 0; i < nCases; i++ {
+		value = make([]byte, 8)
+		binary.BigEndian.PutUint64(value, uint64(i))
+		values64[i] = value
+
+		e = cache.Insert(value)
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache.Recall(values64[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	_, e = NewCache(12, nCases)
+
+	assert.NotNil(t, e)
+
+	return
+}
+
+func TestBloomCache(t *testing.T) {
+	const (
+		nCases = 1 << 10
+	)
+
+	var (
+		cache *ApproxCache
+		e     error
+		found bool
+		i     int
+	)
+
+	cache = NewBloomCache(nCases, 0.01)
+
+	for i = 0; i < nCases; i++ {
+		e = cache.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
+func TestBloomCacheSaveLoad(t *testing.T) {
+	const (
+		nCases = 1 << 8
+	)
+
+	var (
+		buffer bytes.Buffer
+		cache0 *ApproxCache
+		cache1 *ApproxCache
+		e      error
+		found  bool
+		i      int
+	)
+
+	cache0 = NewBloomCache(nCases, 0.01)
+
+	for i = 0; i < nCases; i++ {
+		e = cache0.Insert(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+	}
+
+	e = cache0.Save(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	cache1 = NewBloomCache(nCases, 0.01)
+
+	e = cache1.Load(&buffer)
+	if e != nil {
+		t.Error(e)
+	}
+
+	for i = 0; i < nCases; i++ {
+		found, e = cache1.Recall(values[i])
+		if e != nil {
+			t.Error(e)
+		}
+
+		assert.True(t, found)
+	}
+
+	return
+}
+
 func TestLog(t *testing.T) {
 	assert.Equal(t, 24,
 		log(1<<22, 8),
@@ -0,0 +1,171 @@
+package dejavu
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A RingCache holds the n most-recently-inserted values, evicting the
+// oldest one to make room for a new one instead of ever rejecting an
+// Insert. It suits sliding-window deduplication, such as a replay-attack or
+// RTP packet-dedup window, where only recent history matters and memory
+// must stay bounded.
+//
+// A secondary index keyed by value keeps Recall sub-linear; it costs one
+// map entry per cached value, on top of the flat array holding the values
+// themselves.
+type RingCache struct {
+	memory []byte // flat array of n valLen-sized slots, written circularly
+
+	index map[string]uint64 // value -> sequence number it was inserted at
+
+	mutex sync.Mutex
+
+	valLen int // length of values, in number of bytes
+	n      int // number of slots in the ring
+
+	next int    // slot the next Insert will write to
+	seq  uint64 // number of distinct values ever inserted
+}
+
+// NewRingCache128 creates a new RingCache that holds the n most-recently-
+// inserted 128-bit values.
+func NewRingCache128(n uint32) *RingCache {
+	return newRingCache(128, n)
+}
+
+// Length returns the number of values currently held in the ring.
+func (r *RingCache) Length() int {
+	if r.seq < uint64(r.n) {
+		return int(r.seq)
+	}
+
+	return r.n
+}
+
+// Capacity returns the number of values the ring can hold.
+func (r *RingCache) Capacity() int {
+	return r.n
+}
+
+// Insert caches a value, evicting the oldest cached value once the ring is
+// full. Inserting a value already present is a no-op: it keeps its
+// original position in the window rather than being refreshed.
+func (r *RingCache) Insert(value []byte) (e error) {
+	if len(value) != r.valLen {
+		e = fmt.Errorf("could not insert: value length not equal to %d bytes",
+			r.valLen,
+		)
+
+		return
+	}
+
+	r.mutex.Lock()
+
+	defer r.mutex.Unlock()
+
+	if _, cached := r.index[string(value)]; cached {
+		return
+	}
+
+	if r.seq >= uint64(r.n) {
+		delete(r.index, string(r.val(r.next)))
+	}
+
+	r.setVal(r.next, value)
+
+	r.index[string(value)] = r.seq
+
+	r.next = (r.next + 1) % r.n
+	r.seq++
+
+	return
+}
+
+// Recall returns true if a value is currently held in the ring.
+func (r *RingCache) Recall(value []byte) (cached bool, e error) {
+	if len(value) != r.valLen {
+		e = fmt.Errorf("could not recall: value length not equal to %d bytes",
+			r.valLen,
+		)
+
+		return
+	}
+
+	r.mutex.Lock()
+
+	defer r.mutex.Unlock()
+
+	_, cached = r.index[string(value)]
+
+	return
+}
+
+// RecallWithin returns true if a value was inserted within the last k
+// inserts, using its insertion-order sequence number rather than wall-clock
+// time. A value evicted by the ring wrapping around always reports false,
+// regardless of k.
+func (r *RingCache) RecallWithin(value []byte, k uint64) (cached bool, e error) {
+	if len(value) != r.valLen {
+		e = fmt.Errorf("could not recall: value length not equal to %d bytes",
+			r.valLen,
+		)
+
+		return
+	}
+
+	r.mutex.Lock()
+
+	defer r.mutex.Unlock()
+
+	seq, ok := r.index[string(value)]
+	if !ok {
+		return
+	}
+
+	cached = r.seq-seq <= k
+
+	return
+}
+
+func newRingCache(l uint8, n uint32) (r *RingCache) {
+	// Creates a new RingCache that holds the n most-recently-inserted
+	// l-bit values.
+
+	r = &RingCache{
+		index: make(map[string]uint64, n),
+
+		valLen: int(l / bitsPerByte),
+		n:      int(n),
+	}
+
+	r.memory = make([]byte, int(n)*r.valLen)
+
+	return
+}
+
+func (r *RingCache) val(i int) []byte {
+	// Returns the value currently held in the i-th slot of the ring.
+
+	var (
+		valPos int = i * r.valLen
+	)
+
+	return r.memory[valPos : valPos+r.valLen]
+}
+
+func (r *RingCache) setVal(i int, val []byte) {
+	// Overwrites the value held in the i-th slot of the ring.
+	// Ensure it is only called while the mutex is locked!
+
+	var (
+		j      int
+		valPos int = i * r.valLen
+	)
+
+	for j = 0; j < len(val); j++ {
+		r.memory[valPos+j] = val[j]
+	}
+
+	return
+}
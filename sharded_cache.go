@@ -0,0 +1,264 @@
+package dejavu
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+const (
+	shardedMagic   = "DJVS"
+	shardedVersion = 1
+)
+
+// A ShardedCache fronts a fixed number of *Cache shards, distributing values
+// across them by their leading bits. Each shard keeps its own lock, so an
+// Insert into one shard does not serialize against a Recall (or Insert) that
+// lands in another, keeping contention roughly proportional to 1/N.
+type ShardedCache struct {
+	shards []*Cache
+	locks  []sync.RWMutex
+
+	shardBits uint // number of leading bits of a value used to pick a shard
+}
+
+// NewShardedCache128 creates a new ShardedCache of shards shards, each
+// holding up to nPerShard 128-bit values. shards must be a power of two.
+func NewShardedCache128(nPerShard uint32, shards int) (s *ShardedCache, e error) {
+	return newShardedCache(128, nPerShard, shards)
+}
+
+// Shards returns the number of shards backing the cache.
+func (s *ShardedCache) Shards() int {
+	return len(s.shards)
+}
+
+// Length returns the number of values currently cached, across all shards.
+func (s *ShardedCache) Length() int {
+	var (
+		i      int
+		length int
+	)
+
+	for i = range s.shards {
+		s.locks[i].RLock()
+
+		length += s.shards[i].Length()
+
+		s.locks[i].RUnlock()
+	}
+
+	return length
+}
+
+// Size returns the combined size of the underlying shards, in number of
+// bytes.
+func (s *ShardedCache) Size() int {
+	var (
+		i    int
+		size int
+	)
+
+	for i = range s.shards {
+		size += s.shards[i].Size()
+	}
+
+	return size
+}
+
+// Full returns true if every shard holds as many values as it can.
+func (s *ShardedCache) Full() bool {
+	var (
+		i int
+	)
+
+	for i = range s.shards {
+		s.locks[i].RLock()
+
+		full := s.shards[i].Full()
+
+		s.locks[i].RUnlock()
+
+		if !full {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Insert caches a value, routing it to the shard its leading bits select.
+func (s *ShardedCache) Insert(value []byte) (e error) {
+	var (
+		i int = s.shard(value)
+	)
+
+	s.locks[i].Lock()
+
+	defer s.locks[i].Unlock()
+
+	return s.shards[i].Insert(value)
+}
+
+// Recall returns true if a value has been cached, false otherwise.
+func (s *ShardedCache) Recall(value []byte) (cached bool, e error) {
+	var (
+		i int = s.shard(value)
+	)
+
+	s.locks[i].RLock()
+
+	defer s.locks[i].RUnlock()
+
+	return s.shards[i].Recall(value)
+}
+
+// Save writes all shards to an [io.Writer] in a stable order, behind a small
+// envelope header identifying the format and shard count.
+func (s *ShardedCache) Save(writer io.Writer) (e error) {
+	var (
+		i int
+	)
+
+	_, e = io.WriteString(writer, shardedMagic)
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, uint8(shardedVersion))
+	if e != nil {
+		return
+	}
+
+	e = binary.Write(writer, binary.BigEndian, uint32(len(s.shards)))
+	if e != nil {
+		return
+	}
+
+	for i = range s.shards {
+		s.locks[i].RLock()
+
+		e = s.shards[i].Save(writer)
+
+		s.locks[i].RUnlock()
+
+		if e != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Counterpart to Save, Load reads and inserts shards from an [io.Reader],
+// after verifying the envelope header matches this cache's shard count.
+func (s *ShardedCache) Load(reader io.Reader) (e error) {
+	var (
+		i       int
+		magic   = make([]byte, len(shardedMagic))
+		version uint8
+		shards  uint32
+	)
+
+	_, e = io.ReadFull(reader, magic)
+	if e != nil {
+		return
+	}
+
+	if string(magic) != shardedMagic {
+		e = fmt.Errorf("could not load: bad magic %q", magic)
+
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &version)
+	if e != nil {
+		return
+	}
+
+	if version != shardedVersion {
+		e = fmt.Errorf("could not load: unsupported version %d", version)
+
+		return
+	}
+
+	e = binary.Read(reader, binary.BigEndian, &shards)
+	if e != nil {
+		return
+	}
+
+	if int(shards) != len(s.shards) {
+		e = fmt.Errorf("could not load: shard count %d does not match %d",
+			shards, len(s.shards),
+		)
+
+		return
+	}
+
+	for i = range s.shards {
+		s.locks[i].Lock()
+
+		e = s.shards[i].Load(reader)
+
+		s.locks[i].Unlock()
+
+		if e != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func newShardedCache(l uint16, nPerShard uint32, shards int) (s *ShardedCache, e error) {
+	// Creates a new ShardedCache of shards shards, each holding up to
+	// nPerShard l-bit values. shards must be a power of two.
+
+	var (
+		i int
+	)
+
+	if shards <= 0 || shards&(shards-1) != 0 {
+		e = fmt.Errorf("could not create sharded cache: shard count %d is not a power of two",
+			shards,
+		)
+
+		return
+	}
+
+	s = &ShardedCache{
+		shards:    make([]*Cache, shards),
+		locks:     make([]sync.RWMutex, shards),
+		shardBits: uint(log(shards, 1)),
+	}
+
+	for i = 0; i < shards; i++ {
+		s.shards[i] = newCache(l, nPerShard, PolicyNone, false)
+	}
+
+	return
+}
+
+func (s *ShardedCache) shard(value []byte) int {
+	// Returns the index of the shard a value is routed to, taken from the
+	// top shardBits bits of the value. Reads as many leading bytes as
+	// shardBits needs, rather than just the first one, so shard counts
+	// above 256 (shardBits > 8) are still routed correctly.
+
+	if s.shardBits == 0 {
+		return 0
+	}
+
+	var (
+		nBytes = int((s.shardBits + bitsPerByte - 1) / bitsPerByte)
+		i      int
+		v      uint64
+	)
+
+	for i = 0; i < nBytes; i++ {
+		v = v<<bitsPerByte | uint64(value[i])
+	}
+
+	return int(v >> (uint(nBytes)*bitsPerByte - s.shardBits))
+}